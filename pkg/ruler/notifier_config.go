@@ -0,0 +1,172 @@
+package ruler
+
+import (
+	native_ctx "context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// NotifierConfigStore supplies the per-tenant Alertmanager notification
+// configuration (Alertmanager targets, HTTP client config,
+// alert_relabel_configs and external_labels/external_url) used to build
+// each tenant's rulerNotifier. Each tenant's config uses the same schema as
+// a Prometheus configuration file, plus a top-level external_url field.
+type NotifierConfigStore interface {
+	// Configs returns the current Alertmanager configuration for every
+	// tenant known to the store.
+	Configs(ctx native_ctx.Context) (map[string]*TenantNotifierConfig, error)
+}
+
+// NewNotifierConfigStore builds a NotifierConfigStore from the given ruler
+// Config, or returns a nil store if no backend is configured. With a nil
+// store every tenant falls back to the single Alertmanager configured with
+// -ruler.alertmanager-url.
+func NewNotifierConfigStore(cfg Config) (NotifierConfigStore, error) {
+	switch cfg.AlertmanagerConfigBackend {
+	case "":
+		return nil, nil
+
+	case "local":
+		if cfg.AlertmanagerConfigDirectory == "" {
+			return nil, fmt.Errorf("-ruler.alertmanager-config-directory must be set when -ruler.alertmanager-config-backend=local")
+		}
+		return &directoryNotifierConfigStore{dir: cfg.AlertmanagerConfigDirectory}, nil
+
+	case "configdb":
+		if cfg.AlertmanagerConfigDBURL.URL == nil {
+			return nil, fmt.Errorf("-ruler.alertmanager-configdb-url must be set when -ruler.alertmanager-config-backend=configdb")
+		}
+		return &configDBNotifierConfigStore{
+			url:    strings.TrimSuffix(cfg.AlertmanagerConfigDBURL.URL.String(), "/"),
+			client: http.DefaultClient,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unrecognised -ruler.alertmanager-config-backend %q", cfg.AlertmanagerConfigBackend)
+	}
+}
+
+// directoryNotifierConfigStore loads one YAML file per tenant, named
+// <userID>.yaml, out of a local directory.
+type directoryNotifierConfigStore struct {
+	dir string
+}
+
+func (d *directoryNotifierConfigStore) Configs(_ native_ctx.Context) (map[string]*TenantNotifierConfig, error) {
+	matches, err := filepath.Glob(filepath.Join(d.dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	cfgs := make(map[string]*TenantNotifierConfig, len(matches))
+	for _, path := range matches {
+		userID := strings.TrimSuffix(filepath.Base(path), ".yaml")
+
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg, err := unmarshalNotifierConfig(buf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alertmanager config for tenant %q: %v", userID, err)
+		}
+		cfgs[userID] = cfg
+	}
+	return cfgs, nil
+}
+
+// configDBNotifierConfigStore fetches per-tenant Alertmanager configuration
+// from a configs service, the same service used elsewhere in Cortex to store
+// per-tenant rule groups.
+type configDBNotifierConfigStore struct {
+	url    string
+	client *http.Client
+}
+
+type configDBAlertmanagerResponse struct {
+	Configs map[string]struct {
+		// Config is the YAML-encoded `alerting:` section for this tenant.
+		Config string `json:"config"`
+	} `json:"configs"`
+}
+
+func (c *configDBNotifierConfigStore) Configs(ctx native_ctx.Context) (map[string]*TenantNotifierConfig, error) {
+	req, err := http.NewRequest("GET", c.url+"/api/prom/configs/alertmanager", nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("configdb returned status %d", resp.StatusCode)
+	}
+
+	var body configDBAlertmanagerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	cfgs := make(map[string]*TenantNotifierConfig, len(body.Configs))
+	for userID, entry := range body.Configs {
+		cfg, err := unmarshalNotifierConfig([]byte(entry.Config))
+		if err != nil {
+			return nil, fmt.Errorf("invalid alertmanager config for tenant %q: %v", userID, err)
+		}
+		cfgs[userID] = cfg
+	}
+	return cfgs, nil
+}
+
+// unmarshalNotifierConfig parses a tenant's Alertmanager configuration,
+// using the same schema as a whole Prometheus config file (its `global:`
+// and `alerting:` sections are the ones that matter here), plus a top-level
+// external_url field.
+//
+// It can't just yaml.UnmarshalStrict straight into a TenantNotifierConfig:
+// TenantNotifierConfig embeds config.Config with `yaml:",inline"`, but
+// yaml.v2 decodes an inlined field structurally and never calls the
+// embedded type's own UnmarshalYAML, so config.Config's defaulting (global
+// defaults, per-AlertmanagerConfig defaults, etc.) would silently never
+// run. Instead, external_url is peeled off into a generic map first, and
+// the rest is handed to config.Config directly, the same way Prometheus's
+// own config.Load parses a full configuration file.
+func unmarshalNotifierConfig(buf []byte) (*TenantNotifierConfig, error) {
+	var raw map[string]interface{}
+	if err := yaml.UnmarshalStrict(buf, &raw); err != nil {
+		return nil, err
+	}
+
+	cfg := &TenantNotifierConfig{}
+	if v, ok := raw["external_url"]; ok {
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(b, &cfg.ExternalURL); err != nil {
+			return nil, fmt.Errorf("invalid external_url: %v", err)
+		}
+		delete(raw, "external_url")
+	}
+
+	rest, err := yaml.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(rest, &cfg.Config); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
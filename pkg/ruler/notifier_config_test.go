@@ -0,0 +1,67 @@
+package ruler
+
+import (
+	"testing"
+)
+
+func TestUnmarshalNotifierConfig(t *testing.T) {
+	buf := []byte(`
+external_url: http://ruler.example.com/
+global:
+  external_labels:
+    cluster: prod
+alerting:
+  alert_relabel_configs:
+  - source_labels: [severity]
+    regex: debug
+    action: drop
+  alertmanagers:
+  - scheme: https
+    static_configs:
+    - targets: ["alertmanager:9093"]
+`)
+
+	cfg, err := unmarshalNotifierConfig(buf)
+	if err != nil {
+		t.Fatalf("unmarshalNotifierConfig: %v", err)
+	}
+
+	if cfg.ExternalURL.URL == nil || cfg.ExternalURL.URL.String() != "http://ruler.example.com/" {
+		t.Fatalf("external_url not parsed, got %v", cfg.ExternalURL.URL)
+	}
+
+	if v := cfg.GlobalConfig.ExternalLabels["cluster"]; v != "prod" {
+		t.Fatalf("expected external_labels.cluster=prod, got %q", v)
+	}
+
+	if len(cfg.AlertingConfig.AlertmanagerConfigs) != 1 {
+		t.Fatalf("expected 1 alertmanager config, got %d", len(cfg.AlertingConfig.AlertmanagerConfigs))
+	}
+	if cfg.AlertingConfig.AlertmanagerConfigs[0].Scheme != "https" {
+		t.Fatalf("expected scheme https, got %q", cfg.AlertingConfig.AlertmanagerConfigs[0].Scheme)
+	}
+
+	if len(cfg.AlertingConfig.AlertRelabelConfigs) != 1 {
+		t.Fatalf("expected 1 alert_relabel_config, got %d", len(cfg.AlertingConfig.AlertRelabelConfigs))
+	}
+
+	// global.scrape_interval isn't set anywhere above: if config.Config's
+	// own UnmarshalYAML (and its defaulting) was actually invoked, it comes
+	// out at Prometheus's default, not the zero value. Embedding
+	// config.Config with `yaml:",inline"` and decoding the whole struct in
+	// one pass bypasses that defaulting entirely, which is the regression
+	// this test guards against.
+	if cfg.GlobalConfig.ScrapeInterval == 0 {
+		t.Fatalf("expected global.scrape_interval to be defaulted by config.Config.UnmarshalYAML, got zero value")
+	}
+}
+
+func TestUnmarshalNotifierConfigRejectsUnknownFields(t *testing.T) {
+	buf := []byte(`
+external_url: http://ruler.example.com/
+not_a_real_field: true
+`)
+	if _, err := unmarshalNotifierConfig(buf); err == nil {
+		t.Fatalf("expected an error for an unrecognised top-level field, got nil")
+	}
+}
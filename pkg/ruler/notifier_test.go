@@ -0,0 +1,157 @@
+package ruler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gklog "github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/notifier"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/weaveworks/cortex/pkg/util"
+)
+
+// newTestRulerNotifier builds a rulerNotifier configured to send to amURL,
+// reusing buildNotifierConfig exactly as NewRuler does.
+func newTestRulerNotifier(t *testing.T, amURL string) *rulerNotifier {
+	t.Helper()
+	u, err := url.Parse(amURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantCfg, err := buildNotifierConfig(&Config{
+		AlertmanagerURL:     util.URLValue{URL: u},
+		NotificationTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rn := newRulerNotifier(&notifier.Options{QueueCapacity: 10}, gklog.NewNopLogger())
+	if err := rn.applyConfig(tenantCfg); err != nil {
+		t.Fatal(err)
+	}
+	return rn
+}
+
+func TestDrainReturnsImmediatelyWhenQueueEmpty(t *testing.T) {
+	rn := newTestRulerNotifier(t, "http://unused.invalid")
+
+	start := time.Now()
+	rn.drain(time.Second)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("drain() with an empty queue took %s, expected it to return immediately", elapsed)
+	}
+}
+
+func TestDrainTimesOutWhenNothingConsumesTheQueue(t *testing.T) {
+	rn := newTestRulerNotifier(t, "http://unused.invalid")
+	// rn.run() is deliberately never called, so nothing ever sends what's
+	// enqueued below and the queue can never drain to zero.
+	rn.notifier.Send(&notifier.Alert{Labels: labels.FromStrings("alertname", "test")})
+	if got := rn.queueLen(); got != 1 {
+		t.Fatalf("expected queue length 1 after Send, got %d", got)
+	}
+
+	timeout := 50 * time.Millisecond
+	start := time.Now()
+	rn.drain(timeout)
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Fatalf("drain() returned after %s, before its %s timeout elapsed", elapsed, timeout)
+	}
+	if got := rn.queueLen(); got != 1 {
+		t.Fatalf("expected queue to still hold the undrained alert after timing out, got length %d", got)
+	}
+}
+
+func TestDrainReturnsOnceAlertmanagerConsumesTheQueue(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	rn := newTestRulerNotifier(t, srv.URL)
+	rn.run()
+	defer rn.stop()
+
+	rn.notifier.Send(&notifier.Alert{Labels: labels.FromStrings("alertname", "test")})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rn.queueLen() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := rn.queueLen(); got != 0 {
+		t.Fatalf("expected the fake alertmanager to drain the queue, but queueLen is still %d", got)
+	}
+
+	start := time.Now()
+	rn.drain(5 * time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("drain() took %s once the queue was already empty, expected it to return promptly", elapsed)
+	}
+	if atomic.LoadInt32(&requests) == 0 {
+		t.Fatalf("expected the fake alertmanager to have received at least one request")
+	}
+}
+
+// TestRulerStopDrainsNotifiersInParallel guards against the fan-out in
+// Ruler.Stop regressing into a sequential drain: with N per-tenant
+// notifiers whose queues never drain (no Alertmanager consuming them), Stop
+// should take roughly one notificationDrainTimeout in total, not N of them.
+func TestRulerStopDrainsNotifiersInParallel(t *testing.T) {
+	const numTenants = 3
+	drainTimeout := 200 * time.Millisecond
+
+	r := &Ruler{
+		notifiers:                        map[string]*rulerNotifier{},
+		drainNotificationQueueOnShutdown: true,
+		notificationDrainTimeout:         drainTimeout,
+	}
+	for i := 0; i < numTenants; i++ {
+		rn := newTestRulerNotifier(t, "http://unused.invalid")
+		rn.notifier.Send(&notifier.Alert{Labels: labels.FromStrings("alertname", "test")})
+		r.notifiers[string(rune('a'+i))] = rn
+	}
+
+	start := time.Now()
+	r.Stop()
+	elapsed := time.Since(start)
+
+	if elapsed < drainTimeout {
+		t.Fatalf("Ruler.Stop returned after %s, before the %s drain timeout could have elapsed for any notifier", elapsed, drainTimeout)
+	}
+	if elapsed > numTenants*drainTimeout {
+		// A strict < would be flaky under load; comparing against the fully
+		// sequential duration is enough to catch a real regression back to
+		// draining one tenant at a time.
+		t.Fatalf("Ruler.Stop took %s draining %d notifiers with a %s timeout each: looks sequential, not parallel", elapsed, numTenants, drainTimeout)
+	}
+}
+
+// TestRulerStopWaitsForAllNotifiers guards against Stop returning before
+// every notifier's own stop() has actually run: each notifier's sdCtx must
+// be cancelled (stop()'s first step) by the time Stop() returns, for every
+// tenant, not just whichever goroutine happened to finish first.
+func TestRulerStopWaitsForAllNotifiers(t *testing.T) {
+	const numTenants = 5
+	r := &Ruler{notifiers: map[string]*rulerNotifier{}}
+	for i := 0; i < numTenants; i++ {
+		r.notifiers[string(rune('a'+i))] = newTestRulerNotifier(t, "http://unused.invalid")
+	}
+
+	r.Stop()
+
+	for id, n := range r.notifiers {
+		select {
+		case <-n.sdCtx.Done():
+		default:
+			t.Fatalf("tenant %q's notifier discovery context was not cancelled by Stop()", id)
+		}
+	}
+}
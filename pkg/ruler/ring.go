@@ -0,0 +1,372 @@
+package ruler
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weaveworks/cortex/pkg/util"
+)
+
+// RingConfig configures the optional consistent-hash ring used to shard
+// rule group ownership across ruler replicas, so that running more than one
+// ruler replica doesn't double-evaluate every rule group (and double-fire
+// every alert).
+//
+// Cross-replica sharding requires a KV store shared by every replica
+// (consul, etcd or memberlist); those backends aren't implemented in this
+// tree yet (see newRingKVClient), so only the "inmemory" backend works
+// today, and it only shares the ring within a single process. Until a real
+// shared backend lands, -ruler.sharding-enabled is only useful for tests
+// run in a single process, not for deduplicating across real replicas.
+type RingConfig struct {
+	ShardingEnabled bool
+	// Backend KV store used to hold the ring: "consul", "etcd", "memberlist"
+	// (not yet implemented) or "inmemory" (single-process only).
+	KVStore string
+	// Number of ruler instances that should own (and evaluate) each rule
+	// group, for HA.
+	ReplicationFactor int
+	// How often this instance writes its heartbeat to the ring.
+	HeartbeatPeriod time.Duration
+	// How long an instance can go without a heartbeat before the ring
+	// considers it unhealthy and excludes it from ownership decisions.
+	HeartbeatTimeout time.Duration
+}
+
+// RegisterFlags adds the flags required to config the ruler ring to the
+// given FlagSet.
+func (cfg *RingConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.ShardingEnabled, "ruler.sharding-enabled", false, "Distribute rule group ownership across ruler replicas using a consistent-hash ring. If false, every replica evaluates every rule group. NOTE: the scheduler's work items don't carry a rule group name in this tree, so ownership is currently sharded per-tenant, not per-(tenant, rule group) as the ring's hashing supports -- all of a tenant's rule groups move, and are evaluated, together. Enabling this avoids double-evaluation across replicas, but a tenant with a few large rule groups gets none of the finer-grained load-spreading this flag implies until the work item carries a group name.")
+	f.StringVar(&cfg.KVStore, "ruler.ring.kvstore", "inmemory", "Backend storage for the ruler ring: consul, etcd or memberlist. consul/etcd/memberlist clients aren't wired up in this tree yet (see newRingKVClient), so only \"inmemory\" actually works today; it holds the ring in this process's memory only, so sharding only dedups within a single process, not across replicas, until a real backend is added.")
+	f.IntVar(&cfg.ReplicationFactor, "ruler.replication-factor", 1, "Number of ruler replicas that own (and evaluate) each rule group.")
+	f.DurationVar(&cfg.HeartbeatPeriod, "ruler.ring.heartbeat-period", 5*time.Second, "How often each ruler instance writes its heartbeat to the ring.")
+	f.DurationVar(&cfg.HeartbeatTimeout, "ruler.ring.heartbeat-timeout", time.Minute, "How long an instance can go without a heartbeat before the ring excludes it from rule group ownership.")
+}
+
+// ringInstance is what each ruler replica heartbeats into the ring.
+type ringInstance struct {
+	addr      string
+	token     uint32
+	timestamp time.Time
+}
+
+func (i ringInstance) healthy(now time.Time, timeout time.Duration) bool {
+	return now.Sub(i.timestamp) < timeout
+}
+
+// ringKVClient is the minimal key-value interface the ring needs: a single
+// key holding the full set of registered instances, updated with
+// compare-and-swap so that concurrent heartbeats from different replicas
+// never clobber one another.
+//
+// consul, etcd and memberlist backends all satisfy this with their native
+// CAS primitives; only the in-memory backend (used by tests, and as a
+// placeholder until the other backends are wired up in this tree) lives
+// here.
+type ringKVClient interface {
+	CAS(f func(in map[string]ringInstance) map[string]ringInstance) error
+	Get() (map[string]ringInstance, error)
+}
+
+func newRingKVClient(backend string) (ringKVClient, error) {
+	switch backend {
+	case "", "inmemory":
+		return newInmemoryKVClient(), nil
+	case "consul", "etcd", "memberlist":
+		// TODO: wire up real consul/etcd/memberlist clients; the ingester
+		// ring's KV client wrappers are the natural ones to share once they
+		// live in this tree.
+		return nil, fmt.Errorf("ruler ring backend %q is not yet implemented", backend)
+	default:
+		return nil, fmt.Errorf("unrecognised ruler.ring.kvstore %q", backend)
+	}
+}
+
+type inmemoryKVClient struct {
+	mtx       sync.Mutex
+	instances map[string]ringInstance
+}
+
+func newInmemoryKVClient() *inmemoryKVClient {
+	return &inmemoryKVClient{instances: map[string]ringInstance{}}
+}
+
+func (c *inmemoryKVClient) CAS(f func(in map[string]ringInstance) map[string]ringInstance) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.instances = f(c.instances)
+	return nil
+}
+
+func (c *inmemoryKVClient) Get() (map[string]ringInstance, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	out := make(map[string]ringInstance, len(c.instances))
+	for k, v := range c.instances {
+		out[k] = v
+	}
+	return out, nil
+}
+
+// groupKey identifies a rule group for the purposes of the owned-groups
+// metric below.
+type groupKey struct {
+	userID string
+	group  string
+}
+
+// rulerRing heartbeats this instance into a KV store and uses consistent
+// hashing of (userID, group name) against the set of healthy instances to
+// decide which rule groups this instance owns.
+type rulerRing struct {
+	cfg  RingConfig
+	kv   ringKVClient
+	addr string
+
+	quit chan struct{}
+	done chan struct{}
+
+	ownedGroups prometheus.Gauge
+
+	// known records every (userID, group) owns has ever been asked about,
+	// so updateOwnedGroupsMetric has something to recompute ownership of
+	// and re-publish as ownedGroups on every heartbeat tick.
+	knownMtx sync.Mutex
+	known    map[groupKey]struct{}
+}
+
+func newRulerRing(cfg RingConfig, addr string) (*rulerRing, error) {
+	kv, err := newRingKVClient(cfg.KVStore)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.KVStore == "" || cfg.KVStore == "inmemory" {
+		level.Warn(util.Logger).Log("msg", "ruler.sharding-enabled is set but ruler.ring.kvstore is \"inmemory\": the ring is only shared within this process, so this will not deduplicate rule evaluation across separate ruler replicas")
+	}
+
+	r := &rulerRing{
+		cfg:   cfg,
+		kv:    kv,
+		addr:  addr,
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+		known: make(map[groupKey]struct{}),
+		ownedGroups: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "cortex",
+			Name:      "ruler_ring_owned_groups",
+			Help:      "Number of rule groups owned by this ruler instance, as decided by the sharding ring.",
+		}),
+	}
+	prometheus.MustRegister(r.ownedGroups)
+
+	if err := r.heartbeat(); err != nil {
+		return nil, err
+	}
+	r.updateOwnedGroupsMetric()
+	go r.loop()
+	return r, nil
+}
+
+func (r *rulerRing) loop() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.cfg.HeartbeatPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.heartbeat(); err != nil {
+				level.Warn(util.Logger).Log("msg", "failed to heartbeat to ruler ring", "err", err)
+			}
+			r.updateOwnedGroupsMetric()
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// updateOwnedGroupsMetric recomputes ownership, against the ring's current
+// membership, of every (userID, group) that owns has ever been asked about
+// (ownsAlert doesn't record anything here), and republishes the count this instance currently owns as
+// ownedGroups. Ownership can change between ticks purely because other
+// replicas joined, left or went unhealthy, even with no new calls to owns.
+func (r *rulerRing) updateOwnedGroupsMetric() {
+	r.knownMtx.Lock()
+	keys := make([]groupKey, 0, len(r.known))
+	for k := range r.known {
+		keys = append(keys, k)
+	}
+	r.knownMtx.Unlock()
+
+	owned := 0
+	for _, k := range keys {
+		owners, err := r.owners(k.userID, k.group)
+		if err != nil {
+			continue
+		}
+		for _, addr := range owners {
+			if addr == r.addr {
+				owned++
+				break
+			}
+		}
+	}
+	r.ownedGroups.Set(float64(owned))
+}
+
+func (r *rulerRing) heartbeat() error {
+	now := time.Now()
+	return r.kv.CAS(func(in map[string]ringInstance) map[string]ringInstance {
+		out := make(map[string]ringInstance, len(in)+1)
+		for addr, inst := range in {
+			// Drop ourselves from whatever was already there; everything
+			// else is kept as-is and will be pruned by healthy() checks at
+			// read time rather than here, so a transient CAS from a dead
+			// instance doesn't race with this one.
+			if addr == r.addr {
+				continue
+			}
+			out[addr] = inst
+		}
+		out[r.addr] = ringInstance{
+			addr:      r.addr,
+			token:     hashKey(r.addr),
+			timestamp: now,
+		}
+		return out
+	})
+}
+
+// stop removes this instance from the ring and stops heartbeating.
+func (r *rulerRing) stop() {
+	close(r.quit)
+	<-r.done
+	_ = r.kv.CAS(func(in map[string]ringInstance) map[string]ringInstance {
+		out := make(map[string]ringInstance, len(in))
+		for addr, inst := range in {
+			if addr != r.addr {
+				out[addr] = inst
+			}
+		}
+		return out
+	})
+	prometheus.Unregister(r.ownedGroups)
+}
+
+// owners returns the addresses of the cfg.ReplicationFactor healthy
+// instances that own the given rule group, in priority order (owners[0] is
+// primary).
+func (r *rulerRing) owners(userID, group string) ([]string, error) {
+	instances, err := r.kv.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	healthy := make([]ringInstance, 0, len(instances))
+	for _, inst := range instances {
+		if inst.healthy(now, r.cfg.HeartbeatTimeout) {
+			healthy = append(healthy, inst)
+		}
+	}
+	if len(healthy) == 0 {
+		// No known-healthy instances (e.g. ring not yet populated): fall
+		// back to owning everything ourselves rather than evaluating
+		// nothing.
+		return []string{r.addr}, nil
+	}
+
+	sort.Slice(healthy, func(i, j int) bool { return healthy[i].token < healthy[j].token })
+
+	key := hashKey(userID + "/" + group)
+	startIdx := sort.Search(len(healthy), func(i int) bool { return healthy[i].token >= key }) % len(healthy)
+
+	n := r.cfg.ReplicationFactor
+	if n <= 0 || n > len(healthy) {
+		n = len(healthy)
+	}
+	owners := make([]string, 0, n)
+	seen := make(map[string]struct{}, n)
+	for i := 0; len(owners) < n; i++ {
+		inst := healthy[(startIdx+i)%len(healthy)]
+		if _, ok := seen[inst.addr]; ok {
+			continue
+		}
+		seen[inst.addr] = struct{}{}
+		owners = append(owners, inst.addr)
+	}
+	return owners, nil
+}
+
+// owns reports whether this instance is one of the owners of the given rule
+// group.
+func (r *rulerRing) owns(userID, group string) (bool, error) {
+	r.knownMtx.Lock()
+	r.known[groupKey{userID, group}] = struct{}{}
+	r.knownMtx.Unlock()
+
+	owners, err := r.owners(userID, group)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range owners {
+		if addr == r.addr {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ownsAlert reports whether this instance is responsible for sending the
+// given alert, identified by fingerprint (a hash of its label set). When
+// -ruler.replication-factor causes more than one replica to own a rule
+// group for HA, every owner evaluates it and would otherwise send every
+// alert it fires once per replica; instead each alert is assigned to
+// exactly one of the group's owners by hashing its fingerprint against
+// them, so Alertmanager only ever sees it once.
+func (r *rulerRing) ownsAlert(userID string, fingerprint uint64) (bool, error) {
+	owners, err := r.owners(userID, "")
+	if err != nil {
+		return false, err
+	}
+	if len(owners) == 0 {
+		return true, nil
+	}
+	return owners[fingerprint%uint64(len(owners))] == r.addr, nil
+}
+
+// defaultInstanceAddr picks the address this instance advertises to the
+// ring when -ruler.ring.instance-addr isn't set: the first non-loopback
+// unicast address it can find, falling back to the hostname.
+func defaultInstanceAddr() string {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() {
+				continue
+			}
+			return ipNet.IP.String()
+		}
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return host
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
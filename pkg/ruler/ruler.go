@@ -6,8 +6,10 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +17,7 @@ import (
 	gklog "github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	config_util "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/config"
@@ -23,8 +26,11 @@ import (
 	"github.com/prometheus/prometheus/discovery/dns"
 	"github.com/prometheus/prometheus/discovery/targetgroup"
 	"github.com/prometheus/prometheus/notifier"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/template"
 	"github.com/prometheus/prometheus/util/strutil"
 	"golang.org/x/net/context"
 	"golang.org/x/net/context/ctxhttp"
@@ -76,6 +82,12 @@ type Config struct {
 	EvaluationInterval time.Duration
 	NumWorkers         int
 
+	// Address this ruler instance advertises to the ring. Only used when
+	// Ring.ShardingEnabled is true.
+	RingInstanceAddr string
+	// Ring used to shard rule group ownership across ruler replicas.
+	Ring RingConfig
+
 	// URL of the Alertmanager to send notifications to.
 	AlertmanagerURL util.URLValue
 	// Whether to use DNS SRV records to discover alertmanagers.
@@ -83,6 +95,13 @@ type Config struct {
 	// How long to wait between refreshing the list of alertmanagers based on
 	// DNS service discovery.
 	AlertmanagerRefreshInterval time.Duration
+	// Path to a YAML file holding a full `alerting:` section (as documented
+	// for Prometheus's own configuration file), used as the global
+	// Alertmanager configuration in place of AlertmanagerURL. Unlike
+	// AlertmanagerURL, this supports every Prometheus service discovery
+	// mechanism (Kubernetes, Consul, EC2, file-SD, ...) and more than one
+	// Alertmanager pool with different auth per pool.
+	AlertmanagerConfigFile string
 
 	// Capacity of the queue for notifications to be sent to the Alertmanager.
 	NotificationQueueCapacity int
@@ -90,6 +109,27 @@ type Config struct {
 	NotificationTimeout time.Duration
 	// Timeout for rule group evaluation, including sending result to ingester
 	GroupTimeout time.Duration
+
+	// Whether to wait for per-tenant notification queues to drain before
+	// stopping their notifiers on shutdown.
+	DrainNotificationQueueOnShutdown bool
+	// How long to wait for a tenant's notification queue to drain before
+	// giving up and dropping whatever is left.
+	NotificationDrainTimeout time.Duration
+
+	// Backend to load per-tenant Alertmanager configuration from: "", "local"
+	// or "configdb". When unset, every tenant shares the single Alertmanager
+	// configured via AlertmanagerURL.
+	AlertmanagerConfigBackend string
+	// Directory to load per-tenant Alertmanager configuration YAML files
+	// from. Only used when AlertmanagerConfigBackend is "local".
+	AlertmanagerConfigDirectory string
+	// URL of the configs service to load per-tenant Alertmanager
+	// configuration from. Only used when AlertmanagerConfigBackend is
+	// "configdb".
+	AlertmanagerConfigDBURL util.URLValue
+	// How often to reload per-tenant Alertmanager configuration.
+	AlertmanagerConfigPollInterval time.Duration
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -98,12 +138,21 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.Var(&cfg.ExternalURL, "ruler.external.url", "URL of alerts return path.")
 	f.DurationVar(&cfg.EvaluationInterval, "ruler.evaluation-interval", 15*time.Second, "How frequently to evaluate rules")
 	f.IntVar(&cfg.NumWorkers, "ruler.num-workers", 1, "Number of rule evaluator worker routines in this process")
+	f.StringVar(&cfg.RingInstanceAddr, "ruler.ring.instance-addr", "", "Address to advertise to the ruler ring. Defaults to the first non-loopback network interface address, or the hostname if there is none.")
+	cfg.Ring.RegisterFlags(f)
 	f.Var(&cfg.AlertmanagerURL, "ruler.alertmanager-url", "URL of the Alertmanager to send notifications to.")
 	f.BoolVar(&cfg.AlertmanagerDiscovery, "ruler.alertmanager-discovery", false, "Use DNS SRV records to discover alertmanager hosts.")
 	f.DurationVar(&cfg.AlertmanagerRefreshInterval, "ruler.alertmanager-refresh-interval", 1*time.Minute, "How long to wait between refreshing alertmanager hosts.")
+	f.StringVar(&cfg.AlertmanagerConfigFile, "ruler.alertmanager-config-file", "", "Path to a YAML file with a full `alerting:` config section, used instead of -ruler.alertmanager-url. Supports every Prometheus service discovery mechanism and multiple Alertmanager pools.")
 	f.IntVar(&cfg.NotificationQueueCapacity, "ruler.notification-queue-capacity", 10000, "Capacity of the queue for notifications to be sent to the Alertmanager.")
 	f.DurationVar(&cfg.NotificationTimeout, "ruler.notification-timeout", 10*time.Second, "HTTP timeout duration when sending notifications to the Alertmanager.")
 	f.DurationVar(&cfg.GroupTimeout, "ruler.group-timeout", 10*time.Second, "Timeout for rule group evaluation, including sending result to ingester")
+	f.BoolVar(&cfg.DrainNotificationQueueOnShutdown, "ruler.drain-notification-queue-on-shutdown", false, "Drain all outstanding alert notifications when shutting down. If false, any queued notifications are dropped.")
+	f.DurationVar(&cfg.NotificationDrainTimeout, "ruler.notification-drain-timeout", 10*time.Second, "Maximum time to wait for each tenant's alert notification queue to drain on shutdown. Only used if ruler.drain-notification-queue-on-shutdown is true.")
+	f.StringVar(&cfg.AlertmanagerConfigBackend, "ruler.alertmanager-config-backend", "", "Backend to load per-tenant Alertmanager configuration from: '', 'local' or 'configdb'. If unset, every tenant shares the Alertmanager configured with -ruler.alertmanager-url.")
+	f.StringVar(&cfg.AlertmanagerConfigDirectory, "ruler.alertmanager-config-directory", "", "Directory containing per-tenant Alertmanager configuration YAML files, named <tenant>.yaml. Only used when -ruler.alertmanager-config-backend=local.")
+	f.Var(&cfg.AlertmanagerConfigDBURL, "ruler.alertmanager-configdb-url", "URL of the configs service to load per-tenant Alertmanager configuration from. Only used when -ruler.alertmanager-config-backend=configdb.")
+	f.DurationVar(&cfg.AlertmanagerConfigPollInterval, "ruler.alertmanager-config-poll-interval", 30*time.Second, "How often to reload per-tenant Alertmanager configuration.")
 }
 
 // Ruler evaluates rules.
@@ -111,13 +160,37 @@ type Ruler struct {
 	engine        *promql.Engine
 	pusher        Pusher
 	alertURL      *url.URL
-	notifierCfg   *config.Config
+	notifierCfg   *TenantNotifierConfig
 	queueCapacity int
 	groupTimeout  time.Duration
 
+	drainNotificationQueueOnShutdown bool
+	notificationDrainTimeout         time.Duration
+
 	// Per-user notifiers with separate queues.
 	notifiersMtx sync.Mutex
 	notifiers    map[string]*rulerNotifier
+
+	// Optional per-tenant Alertmanager configuration, refreshed periodically
+	// by pollNotifierConfigs. Nil if no AlertmanagerConfigBackend is set, in
+	// which case every tenant uses notifierCfg.
+	notifierConfigStore NotifierConfigStore
+	configPollInterval  time.Duration
+	tenantCfgMtx        sync.RWMutex
+	tenantNotifierCfgs  map[string]*TenantNotifierConfig
+	notifierConfigDone  chan struct{}
+
+	// Optional sharding ring, set by NewServer once it's created both the
+	// Ruler and the ring, used to deduplicate alert notifications by
+	// fingerprint when -ruler.replication-factor causes more than one
+	// replica to own (and evaluate) the same rule group.
+	ring *rulerRing
+}
+
+// setRing attaches the sharding ring to the Ruler so sendAlerts can
+// deduplicate notifications across replicas that own the same rule group.
+func (r *Ruler) setRing(ring *rulerRing) {
+	r.ring = ring
 }
 
 // rulerNotifier bundles a notifer.Notifier together with an associated
@@ -130,15 +203,33 @@ type rulerNotifier struct {
 	sdManager *discovery.Manager
 	wg        sync.WaitGroup
 	logger    gklog.Logger
+
+	// relabelConfigs holds the tenant's alert_relabel_configs, applied by
+	// sendAlerts before handing alerts to notifier.Send.
+	relabelMtx     sync.RWMutex
+	relabelConfigs []*relabel.Config
+
+	// externalURL and externalLabels are used by sendAlerts to build
+	// generator links, to expand alert templates and to tag outgoing
+	// alerts, all on a per-tenant basis.
+	extMtx         sync.RWMutex
+	externalURL    *url.URL
+	externalLabels labels.Labels
 }
 
 func newRulerNotifier(o *notifier.Options, l gklog.Logger) *rulerNotifier {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &rulerNotifier{
-		notifier:  notifier.New(o, l),
-		sdCtx:     ctx,
-		sdCancel:  cancel,
-		sdManager: discovery.NewManager(l),
+		notifier: notifier.New(o, l),
+		sdCtx:    ctx,
+		sdCancel: cancel,
+		// The ruler only ever discovers Alertmanagers to notify, never
+		// scrape targets, but we still tag the manager as "notify" (as
+		// Prometheus itself does for its own notify-only discovery
+		// manager) so its metrics and logs are distinguishable from any
+		// scrape-style discovery.Manager that might run in the same
+		// process, and so its SD provider cache isn't shared across roles.
+		sdManager: discovery.NewManager(l, discovery.Name("notify")),
 		logger:    l,
 	}
 }
@@ -146,7 +237,9 @@ func newRulerNotifier(o *notifier.Options, l gklog.Logger) *rulerNotifier {
 func (rn *rulerNotifier) run() {
 	rn.wg.Add(2)
 	go func() {
-		if err := rn.sdManager.Run(rn.sdCtx); err != nil {
+		// context.Canceled is expected whenever the ruler shuts down the
+		// discovery manager as part of a clean stop; don't log it as an error.
+		if err := rn.sdManager.Run(rn.sdCtx); err != nil && err != context.Canceled {
 			level.Error(rn.logger).Log("msg", "error starting notifier discovery manager", "err", err)
 		}
 		rn.wg.Done()
@@ -157,11 +250,76 @@ func (rn *rulerNotifier) run() {
 	}()
 }
 
-func (rn *rulerNotifier) applyConfig(cfg *config.Config) error {
-	if err := rn.notifier.ApplyConfig(cfg); err != nil {
+// queueLen reports the number of alerts still sitting in the notifier's send
+// queue. notifier.Notifier doesn't expose this directly, so we read it back
+// out of the prometheus_notifications_queue_length gauge it registers as
+// part of its Collector implementation.
+func (rn *rulerNotifier) queueLen() int {
+	ch := make(chan prometheus.Metric, 8)
+	go func() {
+		rn.notifier.Collect(ch)
+		close(ch)
+	}()
+
+	// Drain ch fully rather than returning as soon as queue_length is
+	// found: notifier.Notifier.Collect can emit more metrics than the
+	// channel's buffer, and returning early would leave the Collect
+	// goroutine blocked forever trying to send the rest.
+	length := 0
+	for m := range ch {
+		if !strings.Contains(m.Desc().String(), "queue_length") {
+			continue
+		}
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil || pb.Gauge == nil {
+			continue
+		}
+		length = int(pb.Gauge.GetValue())
+	}
+	return length
+}
+
+// drain blocks until the notifier's send queue is empty or timeout elapses,
+// whichever comes first.
+func (rn *rulerNotifier) drain(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if rn.queueLen() == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			level.Warn(rn.logger).Log("msg", "timed out waiting for notification queue to drain, dropping remaining notifications", "queue_len", rn.queueLen())
+			return
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func (rn *rulerNotifier) applyConfig(cfg *TenantNotifierConfig) error {
+	if err := rn.notifier.ApplyConfig(&cfg.Config); err != nil {
 		return err
 	}
 
+	rn.relabelMtx.Lock()
+	rn.relabelConfigs = cfg.AlertingConfig.AlertRelabelConfigs
+	rn.relabelMtx.Unlock()
+
+	rn.extMtx.Lock()
+	if cfg.ExternalURL.URL != nil {
+		rn.externalURL = cfg.ExternalURL.URL
+	}
+	rn.externalLabels = labelsFromLabelSet(cfg.GlobalConfig.ExternalLabels)
+	rn.extMtx.Unlock()
+
+	// Keying by config hash (rather than e.g. slice index) means a reload
+	// whose AlertmanagerConfigs are unchanged hands discovery.Manager the
+	// same keys as before, so it leaves those providers running rather than
+	// tearing them down and restarting discovery from scratch; only pools
+	// whose config actually changed get new keys and fresh providers.
 	sdCfgs := make(map[string]sd_config.ServiceDiscoveryConfig)
 	for _, v := range cfg.AlertingConfig.AlertmanagerConfigs {
 		// AlertmanagerConfigs doesn't hold an unique identifier so we use the config hash as the identifier.
@@ -177,6 +335,39 @@ func (rn *rulerNotifier) applyConfig(cfg *config.Config) error {
 	return rn.sdManager.ApplyConfig(sdCfgs)
 }
 
+// currentRelabelConfigs returns the tenant's current alert_relabel_configs.
+func (rn *rulerNotifier) currentRelabelConfigs() []*relabel.Config {
+	rn.relabelMtx.RLock()
+	defer rn.relabelMtx.RUnlock()
+	return rn.relabelConfigs
+}
+
+// currentExternalURL returns the tenant's current ExternalURL, or nil if
+// none has been configured yet.
+func (rn *rulerNotifier) currentExternalURL() *url.URL {
+	rn.extMtx.RLock()
+	defer rn.extMtx.RUnlock()
+	return rn.externalURL
+}
+
+// currentExternalLabels returns the tenant's current external_labels.
+func (rn *rulerNotifier) currentExternalLabels() labels.Labels {
+	rn.extMtx.RLock()
+	defer rn.extMtx.RUnlock()
+	return rn.externalLabels
+}
+
+// labelsFromLabelSet converts a model.LabelSet (the type Prometheus's
+// GlobalConfig.ExternalLabels is expressed in) to a sorted labels.Labels.
+func labelsFromLabelSet(ls model.LabelSet) labels.Labels {
+	out := make(labels.Labels, 0, len(ls))
+	for n, v := range ls {
+		out = append(out, labels.Label{Name: string(n), Value: string(v)})
+	}
+	sort.Sort(out)
+	return out
+}
+
 func (rn *rulerNotifier) stop() {
 	rn.sdCancel()
 	rn.notifier.Stop()
@@ -189,7 +380,13 @@ func NewRuler(cfg Config, d *distributor.Distributor, c *chunk.Store) (*Ruler, e
 	if err != nil {
 		return nil, err
 	}
-	return &Ruler{
+
+	notifierConfigStore, err := NewNotifierConfigStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Ruler{
 		engine:        querier.NewEngine(d, c),
 		pusher:        d,
 		alertURL:      cfg.ExternalURL.URL,
@@ -197,14 +394,94 @@ func NewRuler(cfg Config, d *distributor.Distributor, c *chunk.Store) (*Ruler, e
 		queueCapacity: cfg.NotificationQueueCapacity,
 		notifiers:     map[string]*rulerNotifier{},
 		groupTimeout:  cfg.GroupTimeout,
-	}, nil
+
+		drainNotificationQueueOnShutdown: cfg.DrainNotificationQueueOnShutdown,
+		notificationDrainTimeout:         cfg.NotificationDrainTimeout,
+
+		notifierConfigStore: notifierConfigStore,
+		configPollInterval:  cfg.AlertmanagerConfigPollInterval,
+		tenantNotifierCfgs:  map[string]*TenantNotifierConfig{},
+		notifierConfigDone:  make(chan struct{}),
+	}
+
+	if r.notifierConfigStore != nil {
+		r.reloadNotifierConfigs()
+		go r.pollNotifierConfigs()
+	}
+
+	return r, nil
+}
+
+// pollNotifierConfigs periodically reloads per-tenant Alertmanager
+// configuration from r.notifierConfigStore until the ruler is stopped.
+func (r *Ruler) pollNotifierConfigs() {
+	ticker := time.NewTicker(r.configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.reloadNotifierConfigs()
+		case <-r.notifierConfigDone:
+			return
+		}
+	}
+}
+
+// reloadNotifierConfigs fetches the latest per-tenant Alertmanager
+// configuration and pushes it into any already-running notifiers. Tenants
+// with no notifier running yet pick up their config lazily, the next time
+// getOrCreateNotifier is called for them.
+func (r *Ruler) reloadNotifierConfigs() {
+	cfgs, err := r.notifierConfigStore.Configs(native_ctx.Background())
+	if err != nil {
+		level.Warn(util.Logger).Log("msg", "failed to reload per-tenant alertmanager configs", "err", err)
+		return
+	}
+
+	r.tenantCfgMtx.Lock()
+	r.tenantNotifierCfgs = cfgs
+	r.tenantCfgMtx.Unlock()
+
+	r.notifiersMtx.Lock()
+	defer r.notifiersMtx.Unlock()
+	for userID, cfg := range cfgs {
+		n, ok := r.notifiers[userID]
+		if !ok {
+			continue
+		}
+		if err := n.applyConfig(cfg); err != nil {
+			level.Warn(util.Logger).Log("msg", "failed to apply updated alertmanager config", "user", userID, "err", err)
+		}
+	}
 }
 
 // Builds a Prometheus config.Config from a ruler.Config with just the required
 // options to configure notifications to Alertmanager.
-func buildNotifierConfig(rulerConfig *Config) (*config.Config, error) {
+func buildNotifierConfig(rulerConfig *Config) (*TenantNotifierConfig, error) {
+	if rulerConfig.AlertmanagerConfigFile != "" {
+		// The config file holds a full `alerting:` section, so it can
+		// express anything the URL-only flags below can't: Kubernetes,
+		// Consul or EC2 service discovery, file-SD, or more than one
+		// Alertmanager pool with different auth per pool. It uses the same
+		// schema (and the same parsing helper) as per-tenant configs, since
+		// there's nothing tenant-specific about it here.
+		buf, err := ioutil.ReadFile(rulerConfig.AlertmanagerConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read -ruler.alertmanager-config-file: %v", err)
+		}
+		cfg, err := unmarshalNotifierConfig(buf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -ruler.alertmanager-config-file: %v", err)
+		}
+		if cfg.ExternalURL.URL == nil {
+			cfg.ExternalURL = rulerConfig.ExternalURL
+		}
+		return cfg, nil
+	}
+
 	if rulerConfig.AlertmanagerURL.URL == nil {
-		return &config.Config{}, nil
+		return &TenantNotifierConfig{ExternalURL: rulerConfig.ExternalURL}, nil
 	}
 
 	u := rulerConfig.AlertmanagerURL
@@ -260,7 +537,26 @@ func buildNotifierConfig(rulerConfig *Config) (*config.Config, error) {
 		}
 	}
 
-	return promConfig, nil
+	return &TenantNotifierConfig{
+		Config:      *promConfig,
+		ExternalURL: rulerConfig.ExternalURL,
+	}, nil
+}
+
+// TenantNotifierConfig is a tenant's Alertmanager notification
+// configuration: the standard Prometheus alerting config (Alertmanager
+// targets, HTTP client config, alert_relabel_configs, and
+// global.external_labels) plus the per-tenant ExternalURL used for alert
+// generator links and template expansion, which has no home in the
+// upstream Prometheus config schema.
+type TenantNotifierConfig struct {
+	config.Config `yaml:",inline"`
+
+	// ExternalURL is used to build alert generator links and is handed to
+	// the annotation template expander; templates get no $externalURL
+	// variable bound to it. Defaults to the
+	// ruler's global -ruler.external.url when unset.
+	ExternalURL util.URLValue `yaml:"external_url,omitempty"`
 }
 
 func (r *Ruler) newGroup(ctx context.Context, rs []rules.Rule) (*rules.Group, error) {
@@ -269,16 +565,22 @@ func (r *Ruler) newGroup(ctx context.Context, rs []rules.Rule) (*rules.Group, er
 	if err != nil {
 		return nil, err
 	}
-	notifier, err := r.getOrCreateNotifier(userID)
+	rn, err := r.getOrCreateNotifier(userID)
 	if err != nil {
 		return nil, err
 	}
+
+	externalURL := rn.currentExternalURL()
+	if externalURL == nil {
+		externalURL = r.alertURL
+	}
+
 	opts := &rules.ManagerOptions{
 		Appendable:  appendable,
 		QueryFunc:   rules.EngineQueryFunc(r.engine),
 		Context:     ctx,
-		ExternalURL: r.alertURL,
-		NotifyFunc:  sendAlerts(notifier, r.alertURL.String()),
+		ExternalURL: externalURL,
+		NotifyFunc:  sendAlerts(rn, externalURL, r.engine, r.ring, userID),
 		Logger:      gklog.NewNopLogger(),
 		Registerer:  prometheus.DefaultRegisterer,
 	}
@@ -286,24 +588,83 @@ func (r *Ruler) newGroup(ctx context.Context, rs []rules.Rule) (*rules.Group, er
 	return rules.NewGroup("default", "none", delay, rs, opts), nil
 }
 
+// templateQueryFunc adapts an engine's instant-query evaluation to the
+// signature template.QueryFunc needs for the `query` function in alert
+// annotation templates, using the given ctx so that a tenant's org ID
+// (injected into the evaluation context by the worker) carries through to
+// the query.
+func templateQueryFunc(ctx native_ctx.Context, engine *promql.Engine) template.QueryFunc {
+	queryFunc := rules.EngineQueryFunc(engine)
+	return func(q string) (promql.Vector, error) {
+		return queryFunc(ctx, q, time.Now())
+	}
+}
+
 // sendAlerts implements a rules.NotifyFunc for a Notifier.
-// It filters any non-firing alerts from the input.
+// It drops pending alerts from the input (resolved alerts are still sent,
+// with EndsAt set), tags alerts with the
+// tenant's external_labels, expands annotation templates (so operators can
+// embed $value and humanized quantities in alert messages, as documented
+// for Prometheus notification templating), and applies the tenant's
+// alert_relabel_configs before handing alerts to the notifier.
+//
+// When ring is non-nil (-ruler.sharding-enabled with
+// -ruler.replication-factor > 1 makes more than one replica own the same
+// rule group for HA), each alert is additionally assigned to exactly one
+// owner by hashing its fingerprint, so Alertmanager only ever sees it once.
 //
 // Copied from Prometheus's main.go.
-func sendAlerts(n *notifier.Notifier, externalURL string) rules.NotifyFunc {
+func sendAlerts(rn *rulerNotifier, externalURL *url.URL, engine *promql.Engine, ring *rulerRing, userID string) rules.NotifyFunc {
 	return func(ctx native_ctx.Context, expr string, alerts ...*rules.Alert) error {
 		var res []*notifier.Alert
+		relabelConfigs := rn.currentRelabelConfigs()
+		externalLabels := rn.currentExternalLabels()
+		// Built from this call's own ctx (not cached across calls) so that
+		// `{{ query ... }}` in annotation templates runs with the tenant's
+		// org ID set, the same as the rule evaluation that triggered it.
+		queryFunc := templateQueryFunc(ctx, engine)
 
 		for _, alert := range alerts {
 			// Only send actually firing alerts.
 			if alert.State == rules.StatePending {
 				continue
 			}
+
+			lbls := alert.Labels
+			if len(externalLabels) > 0 {
+				b := labels.NewBuilder(lbls)
+				for _, l := range externalLabels {
+					if lbls.Get(l.Name) == "" {
+						b.Set(l.Name, l.Value)
+					}
+				}
+				lbls = b.Labels()
+			}
+
+			if ring != nil {
+				owned, err := ring.ownsAlert(userID, lbls.Hash())
+				if err != nil {
+					level.Warn(rn.logger).Log("msg", "failed to check ruler ring ownership for alert dedup, sending anyway", "err", err)
+				} else if !owned {
+					continue
+				}
+			}
+
+			annotations := expandAnnotations(ctx, queryFunc, externalURL, lbls, externalLabels, alert.Value, alert.Annotations)
+
+			if len(relabelConfigs) > 0 {
+				lbls = relabel.Process(lbls, relabelConfigs...)
+				if lbls == nil {
+					// Alert was dropped by relabeling.
+					continue
+				}
+			}
+
 			a := &notifier.Alert{
 				StartsAt:     alert.FiredAt,
-				Labels:       alert.Labels,
-				Annotations:  alert.Annotations,
-				GeneratorURL: externalURL + strutil.TableLinkForExpression(expr),
+				Labels:       lbls,
+				Annotations:  annotations,
+				GeneratorURL: externalURL.String() + strutil.TableLinkForExpression(expr),
 			}
 			if !alert.ResolvedAt.IsZero() {
 				a.EndsAt = alert.ResolvedAt
@@ -311,20 +672,45 @@ func sendAlerts(n *notifier.Notifier, externalURL string) rules.NotifyFunc {
 			res = append(res, a)
 		}
 
-		if len(alerts) > 0 {
-			n.Send(res...)
+		if len(res) > 0 {
+			rn.notifier.Send(res...)
 		}
 		return nil
 	}
 }
 
-func (r *Ruler) getOrCreateNotifier(userID string) (*notifier.Notifier, error) {
+// expandAnnotations runs each annotation value through Prometheus's alert
+// notification template language, binding $labels, $externalLabels and
+// $value, alongside the usual query/first/humanize* helpers. An annotation
+// that fails to expand is sent verbatim, with a warning logged.
+func expandAnnotations(ctx native_ctx.Context, queryFunc template.QueryFunc, externalURL *url.URL, lbls, externalLabels labels.Labels, value float64, annotations labels.Labels) labels.Labels {
+	if len(annotations) == 0 {
+		return annotations
+	}
+
+	data := template.AlertTemplateData(lbls.Map(), externalLabels.Map(), value)
+	defs := "{{$labels := .Labels}}{{$externalLabels := .ExternalLabels}}{{$value := .Value}}"
+
+	result := make(labels.Labels, 0, len(annotations))
+	for _, a := range annotations {
+		expander := template.NewTemplateExpander(ctx, defs+a.Value, a.Name, data, model.TimeFromUnixNano(time.Now().UnixNano()), queryFunc, externalURL)
+		text, err := expander.Expand()
+		if err != nil {
+			text = a.Value
+			level.Warn(util.Logger).Log("msg", "failed to expand alert annotation template", "annotation", a.Name, "err", err)
+		}
+		result = append(result, labels.Label{Name: a.Name, Value: text})
+	}
+	return result
+}
+
+func (r *Ruler) getOrCreateNotifier(userID string) (*rulerNotifier, error) {
 	r.notifiersMtx.Lock()
 	defer r.notifiersMtx.Unlock()
 
 	n, ok := r.notifiers[userID]
 	if ok {
-		return n.notifier, nil
+		return n, nil
 	}
 
 	n = newRulerNotifier(&notifier.Options{
@@ -343,14 +729,23 @@ func (r *Ruler) getOrCreateNotifier(userID string) (*notifier.Notifier, error) {
 
 	go n.run()
 
+	cfg := r.notifierCfg
+	if r.notifierConfigStore != nil {
+		r.tenantCfgMtx.RLock()
+		if tenantCfg, ok := r.tenantNotifierCfgs[userID]; ok {
+			cfg = tenantCfg
+		}
+		r.tenantCfgMtx.RUnlock()
+	}
+
 	// This should never fail, unless there's a programming mistake.
-	if err := n.applyConfig(r.notifierCfg); err != nil {
+	if err := n.applyConfig(cfg); err != nil {
 		return nil, err
 	}
 
 	// TODO: Remove notifiers for stale users. Right now this is a slow leak.
 	r.notifiers[userID] = n
-	return n.notifier, nil
+	return n, nil
 }
 
 // Evaluate a list of rules in the given context.
@@ -378,20 +773,37 @@ func (r *Ruler) Evaluate(ctx context.Context, rs []rules.Rule) {
 	rulesProcessed.Add(float64(len(rs)))
 }
 
-// Stop stops the Ruler.
+// Stop stops the Ruler, draining and tearing down all of its per-tenant
+// notifiers in parallel so that a slow Alertmanager for one tenant doesn't
+// serialize shutdown across thousands of tenants.
 func (r *Ruler) Stop() {
+	if r.notifierConfigStore != nil {
+		close(r.notifierConfigDone)
+	}
+
 	r.notifiersMtx.Lock()
 	defer r.notifiersMtx.Unlock()
 
+	var wg sync.WaitGroup
+	wg.Add(len(r.notifiers))
 	for _, n := range r.notifiers {
-		n.stop()
+		go func(n *rulerNotifier) {
+			defer wg.Done()
+			if r.drainNotificationQueueOnShutdown {
+				n.drain(r.notificationDrainTimeout)
+			}
+			n.stop()
+		}(n)
 	}
+	wg.Wait()
 }
 
 // Server is a rules server.
 type Server struct {
 	scheduler *scheduler
 	workers   []worker
+	ruler     *Ruler
+	ring      *rulerRing
 }
 
 // NewServer makes a new rule processing server.
@@ -401,13 +813,30 @@ func NewServer(cfg Config, ruler *Ruler, rulesAPI RulesAPI) (*Server, error) {
 	if cfg.NumWorkers <= 0 {
 		return nil, fmt.Errorf("must have at least 1 worker, got %d", cfg.NumWorkers)
 	}
+
+	var r *rulerRing
+	if cfg.Ring.ShardingEnabled {
+		addr := cfg.RingInstanceAddr
+		if addr == "" {
+			addr = defaultInstanceAddr()
+		}
+		var err error
+		r, err = newRulerRing(cfg.Ring, addr)
+		if err != nil {
+			return nil, err
+		}
+		ruler.setRing(r)
+	}
+
 	workers := make([]worker, cfg.NumWorkers)
 	for i := 0; i < cfg.NumWorkers; i++ {
-		workers[i] = newWorker(&s, ruler)
+		workers[i] = newWorker(&s, ruler, r)
 	}
 	srv := Server{
 		scheduler: &s,
 		workers:   workers,
+		ruler:     ruler,
+		ring:      r,
 	}
 	go srv.run()
 	return &srv, nil
@@ -422,12 +851,18 @@ func (s *Server) run() {
 	level.Info(util.Logger).Log("msg", "ruler up and running")
 }
 
-// Stop the server.
+// Stop the server. Workers and the scheduler are stopped first, so that all
+// in-flight Ruler.Evaluate calls have finished before the ruler's per-tenant
+// notifiers are drained and torn down.
 func (s *Server) Stop() {
 	for _, w := range s.workers {
 		w.Stop()
 	}
 	s.scheduler.Stop()
+	s.ruler.Stop()
+	if s.ring != nil {
+		s.ring.stop()
+	}
 }
 
 // Worker does a thing until it's told to stop.
@@ -439,15 +874,17 @@ type Worker interface {
 type worker struct {
 	scheduler *scheduler
 	ruler     *Ruler
+	ring      *rulerRing
 
 	done       chan struct{}
 	terminated chan struct{}
 }
 
-func newWorker(scheduler *scheduler, ruler *Ruler) worker {
+func newWorker(scheduler *scheduler, ruler *Ruler, ring *rulerRing) worker {
 	return worker{
 		scheduler:  scheduler,
 		ruler:      ruler,
+		ring:       ring,
 		done:       make(chan struct{}),
 		terminated: make(chan struct{}),
 	}
@@ -471,6 +908,21 @@ func (w *worker) Run() {
 		}
 		evalLatency.Observe(time.Since(item.scheduled).Seconds())
 		level.Debug(util.Logger).Log("msg", "processing item", "item", item)
+
+		if w.ring != nil {
+			// NOTE: the scheduler's workItem doesn't carry a rule group
+			// name in this tree, so ownership is sharded per-tenant rather
+			// than per-(tenant, group); all of a tenant's rule groups move
+			// together when the ring reshards.
+			owned, err := w.ring.owns(item.userID, "")
+			if err != nil {
+				level.Warn(util.Logger).Log("msg", "failed to check ruler ring ownership, evaluating anyway", "err", err)
+			} else if !owned {
+				w.scheduler.workItemDone(*item)
+				continue
+			}
+		}
+
 		ctx := user.InjectOrgID(context.Background(), item.userID)
 		w.ruler.Evaluate(ctx, item.rules)
 		w.scheduler.workItemDone(*item)
@@ -0,0 +1,101 @@
+package ruler
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	gklog "github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/notifier"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/rules"
+
+	"github.com/weaveworks/cortex/pkg/util"
+)
+
+// TestSendAlertsMergesExternalLabelsWithExistingPrecedence exercises the
+// real sendAlerts/rulerNotifier path end to end, using notifier.Options.Do
+// (the same hook getOrCreateNotifier uses to inject the tenant's org ID) to
+// capture the outgoing alert without needing a real Alertmanager.
+func TestSendAlertsMergesExternalLabelsWithExistingPrecedence(t *testing.T) {
+	var captured []byte
+	amURL, err := url.Parse("http://alertmanager.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantCfg, err := buildNotifierConfig(&Config{
+		AlertmanagerURL:     util.URLValue{URL: amURL},
+		NotificationTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantCfg.GlobalConfig.ExternalLabels = model.LabelSet{
+		"cluster": "prod",
+		"region":  "us-east",
+	}
+
+	rn := newRulerNotifier(&notifier.Options{
+		QueueCapacity: 10,
+		Do: func(_ context.Context, _ *http.Client, req *http.Request) (*http.Response, error) {
+			b, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			captured = b
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+		},
+	}, gklog.NewNopLogger())
+	if err := rn.applyConfig(tenantCfg); err != nil {
+		t.Fatal(err)
+	}
+	rn.run()
+	defer rn.stop()
+
+	externalURL, err := url.Parse("http://ruler.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// engine is only dereferenced if an annotation calls {{ query ... }};
+	// this test's annotation doesn't, so nil is safe here.
+	notify := sendAlerts(rn, externalURL, nil, nil, "tenant-a")
+
+	alert := &rules.Alert{
+		State:       rules.StateFiring,
+		Labels:      labels.FromStrings("alertname", "HighLatency", "cluster", "custom"),
+		Annotations: labels.FromStrings("summary", "on {{ $externalLabels.region }}"),
+		Value:       42,
+		FiredAt:     time.Now(),
+	}
+	if err := notify(context.Background(), "up", alert); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(captured) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(captured) == 0 {
+		t.Fatalf("alertmanager never received the notification")
+	}
+
+	body := string(captured)
+	if !strings.Contains(body, `"region":"us-east"`) {
+		t.Fatalf("expected external label region=us-east to be merged into the outgoing alert, got: %s", body)
+	}
+	if !strings.Contains(body, `"cluster":"custom"`) {
+		t.Fatalf("expected the alert's own cluster=custom label to take precedence, got: %s", body)
+	}
+	if strings.Contains(body, `"cluster":"prod"`) {
+		t.Fatalf("external_labels.cluster overrode the alert's own cluster label, got: %s", body)
+	}
+	if !strings.Contains(body, "on us-east") {
+		t.Fatalf("expected $externalLabels.region to expand in the annotation template, got: %s", body)
+	}
+}
@@ -0,0 +1,67 @@
+package ruler
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/template"
+)
+
+func noopQueryFunc(q string) (promql.Vector, error) {
+	return promql.Vector{}, nil
+}
+
+func annotationValues(lbls labels.Labels) map[string]string {
+	out := make(map[string]string, len(lbls))
+	for _, l := range lbls {
+		out[l.Name] = l.Value
+	}
+	return out
+}
+
+func TestExpandAnnotationsValueAndHumanize(t *testing.T) {
+	externalURL, err := url.Parse("http://ruler.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lbls := labels.FromStrings("alertname", "HighErrorRate", "job", "api")
+	annotations := labels.FromStrings(
+		"summary", "error rate is {{ $value }}",
+		"description", "that's {{ humanize $value }} errors/sec on {{ $labels.job }}",
+	)
+
+	out := annotationValues(expandAnnotations(context.Background(), template.QueryFunc(noopQueryFunc), externalURL, lbls, nil, 1234567, annotations))
+
+	if !strings.Contains(out["summary"], "1.234567e+06") {
+		t.Fatalf("expected $value to expand to the raw float in Go's default formatting (1.234567e+06), got %q", out["summary"])
+	}
+	if !strings.Contains(out["description"], "on api") {
+		t.Fatalf("expected $labels.job to expand to %q, got %q", "api", out["description"])
+	}
+	if out["description"] == annotations.Get("description") {
+		t.Fatalf("expected the humanize template to expand, got the raw template text back: %q", out["description"])
+	}
+}
+
+func TestExpandAnnotationsFallsBackToRawValueOnError(t *testing.T) {
+	externalURL, err := url.Parse("http://ruler.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lbls := labels.FromStrings("alertname", "Broken")
+	// An unclosed action makes this an invalid template, so Expand() must
+	// error and expandAnnotations should fall back to the raw value rather
+	// than drop or panic on the annotation.
+	const broken = "value is {{ $value"
+	annotations := labels.FromStrings("summary", broken)
+
+	out := annotationValues(expandAnnotations(context.Background(), template.QueryFunc(noopQueryFunc), externalURL, lbls, nil, 1, annotations))
+
+	if out["summary"] != broken {
+		t.Fatalf("expected fallback to the raw annotation value %q on expand error, got %q", broken, out["summary"])
+	}
+}